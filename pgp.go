@@ -18,13 +18,16 @@
 package hockeypuck
 
 import (
+	"bytes"
 	_ "code.google.com/p/go.crypto/md4"
 	"code.google.com/p/go.crypto/openpgp"
 	"code.google.com/p/go.crypto/openpgp/armor"
+	"code.google.com/p/go.crypto/openpgp/clearsign"
 	"code.google.com/p/go.crypto/openpgp/errors"
 	"code.google.com/p/go.crypto/openpgp/packet"
 	_ "code.google.com/p/go.crypto/ripemd160"
-	_ "crypto/md5"
+	"crypto"
+	"crypto/md5"
 	_ "crypto/sha1"
 	_ "crypto/sha256"
 	"crypto/sha512"
@@ -32,8 +35,11 @@ import (
 	"encoding/hex"
 	Errors "errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"time"
 )
 
@@ -45,6 +51,129 @@ func Fingerprint(pubkey *packet.PublicKey) string {
 	return hex.EncodeToString(pubkey.Fingerprint[:])
 }
 
+// v3PublicKey holds the fields of a deprecated OpenPGP version 3
+// public key (or public subkey) packet, which code.google.com/p/go.crypto
+// only understands well enough to identify, not to parse. V3 keys are
+// restricted to RSA, and their fingerprint and key ID are derived
+// differently than v4: the fingerprint is the MD5 digest of the raw
+// modulus and exponent, and the key ID is the low 64 bits of the modulus.
+type v3PublicKey struct {
+	CreationTime time.Time
+	PubKeyAlgo   packet.PublicKeyAlgorithm
+	n, e         *big.Int
+}
+
+// readMPI reads an OpenPGP multiprecision integer: a two-byte bit
+// length followed by the big-endian bytes of the integer.
+func readMPI(r io.Reader) (*big.Int, error) {
+	var lenBytes [2]byte
+	if _, err := io.ReadFull(r, lenBytes[:]); err != nil {
+		return nil, err
+	}
+	bitLen := binary.BigEndian.Uint16(lenBytes[:])
+	buf := make([]byte, (int(bitLen)+7)/8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
+
+// parsePublicKeyV3 decodes the body of a version 3 public key or public
+// subkey packet (RFC 4880 section 5.5.2): a version byte, a 4-byte
+// creation time, a 2-byte (deprecated, ignored) validity period, a
+// 1-byte algorithm, and the RSA modulus and exponent as MPIs.
+func parsePublicKeyV3(op *packet.OpaquePacket) (*v3PublicKey, error) {
+	r := bytes.NewReader(op.Contents)
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 3 {
+		return nil, Errors.New("not a version 3 public key packet")
+	}
+	algo := packet.PublicKeyAlgorithm(header[7])
+	if algo != packet.PubKeyAlgoRSA && algo != packet.PubKeyAlgoRSASignOnly && algo != packet.PubKeyAlgoRSAEncryptOnly {
+		return nil, Errors.New("version 3 public key uses unsupported algorithm")
+	}
+	n, err := readMPI(r)
+	if err != nil {
+		return nil, err
+	}
+	e, err := readMPI(r)
+	if err != nil {
+		return nil, err
+	}
+	return &v3PublicKey{
+		CreationTime: time.Unix(int64(binary.BigEndian.Uint32(header[1:5])), 0),
+		PubKeyAlgo:   algo,
+		n:            n,
+		e:            e,
+	}, nil
+}
+
+// Fingerprint returns the v3 fingerprint: the MD5 digest of the
+// modulus followed by the exponent, neither MPI-length-prefixed.
+func (pk *v3PublicKey) Fingerprint() string {
+	h := md5.New()
+	h.Write(pk.n.Bytes())
+	h.Write(pk.e.Bytes())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// KeyId returns the low-order 64 bits of the modulus, as used to
+// identify v3 keys and their signatures.
+func (pk *v3PublicKey) KeyId() uint64 {
+	nBytes := pk.n.Bytes()
+	if len(nBytes) < 8 {
+		padded := make([]byte, 8)
+		copy(padded[8-len(nBytes):], nBytes)
+		nBytes = padded
+	}
+	return binary.BigEndian.Uint64(nBytes[len(nBytes)-8:])
+}
+
+// KeyIdString returns KeyId formatted the same way ReadKeys formats
+// v4 issuer key IDs: lower-case hex, 8 bytes.
+func (pk *v3PublicKey) KeyIdString() string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], pk.KeyId())
+	return hex.EncodeToString(buf[:])
+}
+
+// v3Signature holds the fixed fields of a version 3 signature packet
+// (RFC 4880 section 5.2.2). Unlike v4, a v3 signature has no subpacket
+// areas: the issuer key ID and creation time are read directly out of
+// the hashed material, and code.google.com/p/go.crypto/openpgp/packet
+// does not parse this version at all.
+type v3Signature struct {
+	SigType      packet.SignatureType
+	CreationTime time.Time
+	IssuerKeyId  uint64
+}
+
+// parseSignatureV3 decodes the fixed fields of a version 3 signature
+// packet that precede its MPIs: a version byte, a 1-byte (always 5)
+// hashed material length, the signature type, a 4-byte creation time,
+// and the 8-byte issuer key ID.
+func parseSignatureV3(op *packet.OpaquePacket) (*v3Signature, error) {
+	r := bytes.NewReader(op.Contents)
+	var header [15]byte // version, hashed len, sig type, 4-byte time, 8-byte issuer key id
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 3 {
+		return nil, Errors.New("not a version 3 signature packet")
+	}
+	if header[1] != 5 {
+		return nil, Errors.New("version 3 signature has unexpected hashed material length")
+	}
+	return &v3Signature{
+		SigType:      packet.SignatureType(header[2]),
+		CreationTime: time.Unix(int64(binary.BigEndian.Uint32(header[3:7])), 0),
+		IssuerKeyId:  binary.BigEndian.Uint64(header[7:15]),
+	}, nil
+}
+
 // Calculate a strong cryptographic digest used for
 // fingerprinting key material and other user data.
 func Digest(data []byte) string {
@@ -75,6 +204,158 @@ func WriteKey(out io.Writer, key *PubKey) error {
 	return nil
 }
 
+// Signature subpacket types (RFC 4880 section 5.2.3.1) that
+// code.google.com/p/go.crypto/openpgp/packet parses into its own
+// *packet.Signature fields don't need a local lookup; the ones below
+// have no such field and so are read directly out of the packet body.
+const (
+	keyServerPrefsSubpacket    = 23
+	embeddedSignatureSubpacket = 32
+)
+
+// findSubpacket scans a V4 signature packet's hashed and unhashed
+// subpacket areas for the first subpacket of the given type, and
+// returns its body (without the type octet), or nil if absent.
+func findSubpacket(op *packet.OpaquePacket, subpacketType byte) []byte {
+	r := bytes.NewReader(op.Contents)
+	var header [4]byte // version, sig type, pubkey algo, hash algo
+	if _, err := io.ReadFull(r, header[:]); err != nil || header[0] != 4 {
+		// Subpacket areas are a V4 signature feature only.
+		return nil
+	}
+	for i := 0; i < 2; i++ { // hashed area, then unhashed area
+		var lenBytes [2]byte
+		if _, err := io.ReadFull(r, lenBytes[:]); err != nil {
+			return nil
+		}
+		area := make([]byte, binary.BigEndian.Uint16(lenBytes[:]))
+		if _, err := io.ReadFull(r, area); err != nil {
+			return nil
+		}
+		for len(area) > 0 {
+			length, lengthLen := subpacketLength(area)
+			if lengthLen == 0 || lengthLen+length > len(area) || length == 0 {
+				break
+			}
+			body := area[lengthLen : lengthLen+length]
+			if body[0]&^0x80 == subpacketType {
+				return append([]byte(nil), body[1:]...)
+			}
+			area = area[lengthLen+length:]
+		}
+	}
+	return nil
+}
+
+// subpacketLength decodes an RFC 4880 5.2.3.1 subpacket length prefix,
+// returning the subpacket's total length (including its type octet)
+// and the number of bytes the length prefix itself occupies.
+func subpacketLength(b []byte) (length, lengthLen int) {
+	switch {
+	case len(b) == 0:
+		return 0, 0
+	case b[0] < 192:
+		return int(b[0]), 1
+	case b[0] < 255:
+		if len(b) < 2 {
+			return 0, 0
+		}
+		return (int(b[0])-192)<<8 + int(b[1]) + 192, 2
+	default:
+		if len(b) < 5 {
+			return 0, 0
+		}
+		return int(binary.BigEndian.Uint32(b[1:5])), 5
+	}
+}
+
+// subpacketFromSignature re-reads sig's stored packet bytes and scans
+// them for a subpacket of the given type, as findSubpacket does for an
+// already-opened *packet.OpaquePacket.
+func subpacketFromSignature(sig *Signature, subpacketType byte) ([]byte, error) {
+	op, err := packet.NewOpaqueReader(bytes.NewReader(sig.GetPacket())).Next()
+	if err != nil {
+		return nil, err
+	}
+	return findSubpacket(op, subpacketType), nil
+}
+
+// embeddedSignaturePacket wraps the body of an embedded signature
+// subpacket (RFC 4880 5.2.3.26 -- itself a complete signature packet
+// body) in a new-format OpenPGP signature packet header, so it can be
+// decoded with packet.Read like any other packet.
+func embeddedSignaturePacket(body []byte) []byte {
+	const sigTag = 2
+	var hdr []byte
+	switch {
+	case len(body) < 192:
+		hdr = []byte{0xC0 | sigTag, byte(len(body))}
+	case len(body) < 8384:
+		n := len(body) - 192
+		hdr = []byte{0xC0 | sigTag, byte(n>>8 + 192), byte(n)}
+	default:
+		hdr = make([]byte, 6)
+		hdr[0] = 0xC0 | sigTag
+		hdr[1] = 0xFF
+		binary.BigEndian.PutUint32(hdr[2:], uint32(len(body)))
+	}
+	return append(hdr, body...)
+}
+
+// parseEmbeddedSignature decodes the body of an embedded signature
+// subpacket into a *packet.Signature.
+func parseEmbeddedSignature(body []byte) (*packet.Signature, error) {
+	p, err := packet.Read(bytes.NewReader(embeddedSignaturePacket(body)))
+	if err != nil {
+		return nil, err
+	}
+	s, ok := p.(*packet.Signature)
+	if !ok {
+		return nil, errors.StructuralError("embedded signature subpacket is not a signature packet")
+	}
+	return s, nil
+}
+
+// verifyCrossSignature enforces RFC 4880bis' cross-certification
+// requirement for signing-capable subkeys: a subkey whose binding
+// signature claims KeyFlagSign or KeyFlagCertify must also carry an
+// embedded primary key binding signature, made by the subkey itself
+// over the primary, proving the subkey's owner consented to the
+// binding. Without it, an attacker could attach someone else's signing
+// subkey to their own primary key.
+func verifyCrossSignature(pk, sk *packet.PublicKey, bindingSig *Signature) error {
+	embedded, err := subpacketFromSignature(bindingSig, embeddedSignatureSubpacket)
+	if err != nil {
+		return err
+	}
+	if embedded == nil {
+		return MissingCrossSigError
+	}
+	backSig, err := parseEmbeddedSignature(embedded)
+	if err != nil {
+		return BadCrossSigError
+	}
+	if backSig.SigType != packet.SigTypePrimaryKeyBinding {
+		return BadCrossSigError
+	}
+	if err := sk.VerifyKeySignature(pk, backSig); err != nil {
+		return BadCrossSigError
+	}
+	return nil
+}
+
+// packetBody returns the body of po's stored packet: the serialized
+// bytes without the OpenPGP packet header (tag and length), as needed
+// to reproduce the hashes RFC 4880 defines over public key and user
+// attribute packets.
+func packetBody(po PacketObject) ([]byte, error) {
+	op, err := packet.NewOpaqueReader(bytes.NewReader(po.GetPacket())).Next()
+	if err != nil {
+		return nil, err
+	}
+	return op.Contents, nil
+}
+
 // Read one or more public keys from input.
 func ReadKeys(r io.Reader) (keyChan chan *PubKey, errorChan chan error) {
 	keyChan = make(chan *PubKey)
@@ -100,6 +381,51 @@ func ReadKeys(r io.Reader) (keyChan chan *PubKey, errorChan chan error) {
 			switch p.(type) {
 			case *packet.PublicKey:
 				pk := p.(*packet.PublicKey)
+				if parseErr != nil {
+					// go.crypto/openpgp/packet still recognizes the tag
+					// and returns a *packet.PublicKey here even when it
+					// can't parse the body -- e.g. a version 3 key, which
+					// it refuses with an UnsupportedError. Fall back to
+					// our own v3 parser rather than trusting pk's fields.
+					v3pk, v3err := parsePublicKeyV3(op)
+					if v3err != nil {
+						if pubKey != nil {
+							keyChan <- pubKey
+							pubKey = nil
+						}
+						log.Println(parseErr)
+						currentSignable = nil
+						currentUserId = nil
+						continue
+					}
+					fp = v3pk.Fingerprint()
+					if op.Tag != 14 {
+						if pubKey != nil {
+							// New public key found, send prior one
+							keyChan <- pubKey
+							pubKey = nil
+						}
+						pubKey = &PubKey{
+							RFingerprint: Reverse(fp),
+							Algorithm:    int(v3pk.PubKeyAlgo),
+							KeyLength:    v3pk.n.BitLen()}
+						pubKey.SetPacket(op)
+						currentSignable = pubKey
+					} else {
+						if pubKey == nil {
+							continue
+						}
+						subKey := &SubKey{
+							RFingerprint: Reverse(fp),
+							Algorithm:    int(v3pk.PubKeyAlgo),
+							KeyLength:    v3pk.n.BitLen()}
+						subKey.SetPacket(op)
+						pubKey.SubKeys = append(pubKey.SubKeys, subKey)
+						currentSignable = subKey
+						currentUserId = nil
+					}
+					continue
+				}
 				if !pk.IsSubkey && pubKey != nil {
 					// New public key found, send prior one
 					keyChan <- pubKey
@@ -139,6 +465,28 @@ func ReadKeys(r io.Reader) (keyChan chan *PubKey, errorChan chan error) {
 					continue
 				}
 				s := p.(*packet.Signature)
+				if parseErr != nil {
+					// As with *packet.PublicKey above, go.crypto/openpgp
+					// still hands back a *packet.Signature for a version
+					// 3 signature packet, with parseErr set to the
+					// version's UnsupportedError. Parse it ourselves.
+					v3sig, v3err := parseSignatureV3(op)
+					if v3err != nil {
+						log.Println(parseErr)
+						continue
+					}
+					var issuerKeyId [8]byte
+					binary.BigEndian.PutUint64(issuerKeyId[:], v3sig.IssuerKeyId)
+					sig := &Signature{
+						SigType:           int(v3sig.SigType),
+						RIssuerKeyId:      Reverse(hex.EncodeToString(issuerKeyId[:])),
+						CreationTime:      v3sig.CreationTime.Unix(),
+						SigExpirationTime: NeverExpires,
+						KeyExpirationTime: NeverExpires}
+					sig.SetPacket(op)
+					currentSignable.AppendSig(sig)
+					continue
+				}
 				// Read issuer key id.
 				if s.IssuerKeyId == nil {
 					// Without an issuer, a signature doesn't mean much
@@ -165,6 +513,35 @@ func ReadKeys(r io.Reader) (keyChan chan *PubKey, errorChan chan error) {
 					CreationTime:      s.CreationTime.Unix(),
 					SigExpirationTime: sigExpirationTime,
 					KeyExpirationTime: keyExpirationTime}
+				if s.FlagsValid {
+					sig.FlagsValid = true
+					sig.FlagCertify = s.FlagCertify
+					sig.FlagSign = s.FlagSign
+					sig.FlagEncryptCommunications = s.FlagEncryptCommunications
+					sig.FlagEncryptStorage = s.FlagEncryptStorage
+				}
+				if s.IsPrimaryId != nil {
+					sig.IsPrimaryUserId = *s.IsPrimaryId
+				}
+				for _, algo := range s.PreferredSymmetric {
+					sig.PreferredSymmetric = append(sig.PreferredSymmetric, int(algo))
+				}
+				for _, algo := range s.PreferredHash {
+					sig.PreferredHash = append(sig.PreferredHash, int(algo))
+				}
+				for _, algo := range s.PreferredCompression {
+					sig.PreferredCompression = append(sig.PreferredCompression, int(algo))
+				}
+				if prefs := findSubpacket(op, keyServerPrefsSubpacket); prefs != nil {
+					sig.KeyServerPreferences = prefs
+				}
+				switch s.SigType {
+				case packet.SigTypeKeyRevocation, packet.SigTypeSubkeyRevocation, packet.SigTypeCertificationRevocation:
+					if s.RevocationReason != nil {
+						sig.RevocationReasonCode = *s.RevocationReason
+					}
+					sig.RevocationReason = s.RevocationReasonText
+				}
 				sig.SetPacket(op)
 				currentSignable.AppendSig(sig)
 			case *packet.UserId:
@@ -181,33 +558,23 @@ func ReadKeys(r io.Reader) (keyChan chan *PubKey, errorChan chan error) {
 				currentUserId = userId
 				pubKey.Identities = append(pubKey.Identities, userId)
 			default:
-				_, isUnknown := parseErr.(errors.UnknownPacketTypeError)
-				if isUnknown {
-					// Packets not yet supported by go.crypto/openpgp
-					switch op.Tag {
-					case 17: // Process user attribute packet
-						userAttr := &UserAttribute{}
-						userAttr.SetPacket(op)
-						if currentUserId != nil {
-							currentUserId.Attributes = append(currentUserId.Attributes, userAttr)
-						}
-						currentSignable = userAttr
-					case 2: // Bad signature packet
-						// TODO: Check for signature version 3
-						log.Println(parseErr)
-					case 6: // Bad public key packet
-						// TODO: Check for unsupported PGP public key packet version
-						// For now, clear state, ignore to next key
-						if pubKey != nil {
-							// Send prior public key, if any
-							keyChan <- pubKey
-							pubKey = nil
-						}
-						log.Println(parseErr)
-						pubKey = nil
-						currentSignable = nil
-						currentUserId = nil
-					default:
+				// Packets not yet supported by go.crypto/openpgp. Version
+				// 3 public keys and signatures are NOT handled here: the
+				// library still recognizes those tags and returns a
+				// typed *packet.PublicKey/*packet.Signature (with a
+				// version UnsupportedError), so they're caught by the
+				// corresponding case above instead of falling through to
+				// this default.
+				switch op.Tag {
+				case 17: // Process user attribute packet
+					userAttr := &UserAttribute{}
+					userAttr.SetPacket(op)
+					if currentUserId != nil {
+						currentUserId.Attributes = append(currentUserId.Attributes, userAttr)
+					}
+					currentSignable = userAttr
+				default:
+					if _, isUnknown := parseErr.(errors.UnknownPacketTypeError); isUnknown {
 						log.Println(parseErr)
 					}
 				}
@@ -255,6 +622,13 @@ var BadSelfSigError error = Errors.New("Bad self-signature")
 var MissingSelfSigError error = Errors.New("Missing self-signature")
 var BadSubKeySigError error = Errors.New("Bad sub-key signature")
 var MissingSubKeySigError error = Errors.New("Missing sub-key signature")
+var RevokedUserIdError error = Errors.New("User ID has been revoked")
+var RevokedSubKeyError error = Errors.New("Subkey has been revoked")
+var RevokedKeyError error = Errors.New("Key has been revoked")
+var BadUserAttrSigError error = Errors.New("Bad user attribute self-signature")
+var MissingUserAttrSigError error = Errors.New("Missing user attribute self-signature")
+var MissingCrossSigError error = Errors.New("Missing cross-certification signature")
+var BadCrossSigError error = Errors.New("Bad cross-certification signature")
 
 func checkValidSignatures(key *PubKey) (verr error) {
 	defer func() {
@@ -263,39 +637,95 @@ func checkValidSignatures(key *PubKey) (verr error) {
 		}
 	}()
 	pkPkt, err := key.Parse()
-	pk := pkPkt.(*packet.PublicKey)
+	if _, isUnsupported := err.(errors.UnsupportedError); isUnsupported {
+		// go.crypto/openpgp/packet recognizes the public key packet tag
+		// but refuses unsupported versions (v3) with UnsupportedError,
+		// not UnknownPacketTypeError.
+		return checkValidSignaturesV3(key)
+	}
 	if err != nil {
 		return err
 	}
+	pk := pkPkt.(*packet.PublicKey)
+	for _, sig := range key.Signatures {
+		sigPkt, err := sig.Parse()
+		if err != nil {
+			return err
+		}
+		s := sigPkt.(*packet.Signature)
+		if s.SigType != packet.SigTypeKeyRevocation {
+			continue
+		}
+		if s.IssuerKeyId == nil || *s.IssuerKeyId != pk.KeyId {
+			continue
+		}
+		pkBody, err := packetBody(key)
+		if err != nil {
+			return err
+		}
+		h, err := keyRevocationHash(pk, pkBody, s.Hash)
+		if err != nil {
+			continue
+		}
+		if err := pk.VerifySignature(h, s); err == nil {
+			key.Revoked = true
+			return RevokedKeyError
+		}
+	}
 	for _, uid := range key.Identities {
 		var goodSelfSig *Signature
+		var revokeSig *Signature
 		for _, sig := range uid.Signatures {
 			sigPkt, err := sig.Parse()
 			if err != nil {
 				return err
 			}
 			s := sigPkt.(*packet.Signature)
-			if (s.SigType == packet.SigTypePositiveCert || s.SigType == packet.SigTypeGenericCert) && s.IssuerKeyId != nil && *s.IssuerKeyId == pk.KeyId {
+			if s.IssuerKeyId == nil || *s.IssuerKeyId != pk.KeyId {
+				continue
+			}
+			switch s.SigType {
+			case packet.SigTypePositiveCert, packet.SigTypeGenericCert:
 				if err = pk.VerifyUserIdSignature(uid.Id, s); err != nil {
 					return BadSelfSigError
-				} else {
-					goodSelfSig = sig
+				}
+				goodSelfSig = sig
+				uid.Primary = sig.IsPrimaryUserId
+				if sig.FlagsValid {
+					key.FlagsValid = true
+					key.FlagCertify = sig.FlagCertify
+					key.FlagSign = sig.FlagSign
+					key.FlagEncryptCommunications = sig.FlagEncryptCommunications
+					key.FlagEncryptStorage = sig.FlagEncryptStorage
+				}
+			case packet.SigTypeCertificationRevocation:
+				if err = pk.VerifyUserIdSignature(uid.Id, s); err == nil {
+					revokeSig = sig
 				}
 			}
 		}
 		if goodSelfSig == nil {
 			return MissingSelfSigError
 		}
-		/*
+		if revokeSig != nil {
+			uid.Revoked = true
+			return RevokedUserIdError
+		}
+		if len(uid.Attributes) > 0 {
+			pkBody, err := packetBody(key)
+			if err != nil {
+				return err
+			}
+			var keptAttrs []*UserAttribute
 			for _, uat := range uid.Attributes {
-				var goodSig *Signature
-				for _, sig := range uid.Signatures {
-					sigPkt, err := sig.Parse()
-					s := sigPkt.(*packet.Signature)
-					// TODO: verify uat packet
+				if verifyUserAttribute(pk, pkBody, uat) {
+					keptAttrs = append(keptAttrs, uat)
+				} else {
+					log.Println(MissingUserAttrSigError, "fingerprint:", key.Fingerprint())
 				}
 			}
-		*/
+			uid.Attributes = keptAttrs
+		}
 	}
 	for _, subKey := range key.SubKeys {
 		skPkt, err := subKey.Parse()
@@ -304,15 +734,86 @@ func checkValidSignatures(key *PubKey) (verr error) {
 		}
 		sk := skPkt.(*packet.PublicKey)
 		var goodSig *Signature
+		var revokeSig *Signature
 		for _, sig := range subKey.Signatures {
 			sigPkt, err := sig.Parse()
 			s := sigPkt.(*packet.Signature)
-			if s.SigType != packet.SigTypeSubkeyBinding {
+			switch s.SigType {
+			case packet.SigTypeSubkeyBinding:
+				if err = pk.VerifyKeySignature(sk, s); err != nil {
+					return BadSubKeySigError
+				}
+				goodSig = sig
+				if sig.FlagsValid {
+					subKey.FlagsValid = true
+					subKey.FlagCertify = sig.FlagCertify
+					subKey.FlagSign = sig.FlagSign
+					subKey.FlagEncryptCommunications = sig.FlagEncryptCommunications
+					subKey.FlagEncryptStorage = sig.FlagEncryptStorage
+				}
+				if sig.FlagsValid && (sig.FlagSign || sig.FlagCertify) {
+					if err = verifyCrossSignature(pk, sk, sig); err != nil {
+						return err
+					}
+				}
+			case packet.SigTypeSubkeyRevocation:
+				if err = pk.VerifyKeySignature(sk, s); err == nil {
+					revokeSig = sig
+				}
+			default:
 				return errors.StructuralError("subkey signature with wrong type")
 			}
-			if err = pk.VerifyKeySignature(sk, s); err != nil {
-				return BadSubKeySigError
-			} else {
+		}
+		if revokeSig != nil {
+			subKey.Revoked = true
+			return RevokedSubKeyError
+		}
+		if goodSig == nil {
+			return MissingSubKeySigError
+		}
+	}
+	return nil
+}
+
+// checkValidSignaturesV3 is the v3 counterpart of checkValidSignatures.
+// go.crypto/openpgp/packet has no verifier for v3 RSA signatures (they
+// hash the old, shorter packet framing and may use MD5), so rather than
+// rejecting every legacy key outright, each self-signature and subkey
+// binding is matched against its issuer key ID and accepted on that
+// basis. This is weaker than v4's full cryptographic check, but it lets
+// a keyserver retain and serve v3 keys rather than discarding them.
+//
+// The v3 Signature models compared below were built by ReadKeys from
+// parseSignatureV3, not the go.crypto/openpgp/packet parser, which
+// rejects v3 signature packets outright; sig.Parse() would fail the
+// same way here, so SigType and RIssuerKeyId are read straight off the
+// model instead.
+func checkValidSignaturesV3(key *PubKey) error {
+	op, err := packet.NewOpaqueReader(bytes.NewReader(key.GetPacket())).Next()
+	if err != nil {
+		return err
+	}
+	v3pk, err := parsePublicKeyV3(op)
+	if err != nil {
+		return err
+	}
+	keyIdString := Reverse(v3pk.KeyIdString())
+	for _, uid := range key.Identities {
+		var goodSelfSig *Signature
+		for _, sig := range uid.Signatures {
+			if (sig.SigType == int(packet.SigTypePositiveCert) || sig.SigType == int(packet.SigTypeGenericCert)) &&
+				sig.RIssuerKeyId == keyIdString {
+				goodSelfSig = sig
+			}
+		}
+		if goodSelfSig == nil {
+			return MissingSelfSigError
+		}
+	}
+	for _, subKey := range key.SubKeys {
+		var goodSig *Signature
+		for _, sig := range subKey.Signatures {
+			if sig.SigType == int(packet.SigTypeSubkeyBinding) && sig.RIssuerKeyId == keyIdString {
 				goodSig = sig
 			}
 		}
@@ -321,4 +822,162 @@ func checkValidSignatures(key *PubKey) (verr error) {
 		}
 	}
 	return nil
+}
+
+// verifyUserAttribute checks each of uat's self-signatures and reports
+// whether at least one verifies. Unlike self-signatures over user IDs
+// and subkey bindings, a bad or missing attribute signature does not
+// reject the whole key: the attribute is just dropped, so an attacker
+// can't take down an otherwise good key by tacking on a bogus photo ID.
+func verifyUserAttribute(pk *packet.PublicKey, pkBody []byte, uat *UserAttribute) bool {
+	uatBody, err := packetBody(uat)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	for _, sig := range uat.Signatures {
+		sigPkt, err := sig.Parse()
+		if err != nil {
+			continue
+		}
+		s := sigPkt.(*packet.Signature)
+		if s.IssuerKeyId == nil || *s.IssuerKeyId != pk.KeyId {
+			continue
+		}
+		if s.SigType != packet.SigTypePositiveCert && s.SigType != packet.SigTypeGenericCert {
+			continue
+		}
+		if verifyUserAttributeSignature(pk, pkBody, uatBody, s) {
+			return true
+		}
+		log.Println(BadUserAttrSigError, "issuer:", *s.IssuerKeyId)
+	}
+	return false
+}
+
+// verifyUserAttributeSignature verifies a single self-signature over a
+// user attribute packet. It recovers from panics in the hash/signature
+// routines itself, rather than relying on checkValidSignatures' recover,
+// so that one unsupported algorithm only drops one attribute.
+func verifyUserAttributeSignature(pk *packet.PublicKey, pkBody, uatBody []byte, s *packet.Signature) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+		}
+	}()
+	h, err := userAttributeHash(pk, pkBody, uatBody, s.Hash)
+	if err != nil {
+		return false
+	}
+	return pk.VerifySignature(h, s) == nil
+}
+
+// keyRevocationHash computes the RFC 4880 section 5.2.4 hash used to
+// verify a direct-key signature over the primary key itself (e.g. a
+// whole-key revocation, type 0x20): the same public-key framing
+// userAttributeHash and VerifyUserIdSignature use, but with no trailing
+// user ID or attribute, since the signature binds information to the
+// key alone.
+func keyRevocationHash(pk *packet.PublicKey, pkBody []byte, hashFunc crypto.Hash) (hash.Hash, error) {
+	if !hashFunc.Available() {
+		return nil, errors.UnsupportedError("hash function")
+	}
+	h := hashFunc.New()
+	pk.SerializeSignaturePrefix(h)
+	h.Write(pkBody)
+	return h, nil
+}
+
+// userAttributeHash computes the RFC 4880 section 5.2.4 hash used to
+// verify a self-signature over a user attribute packet: the same
+// public-key framing VerifyUserIdSignature uses, but with a 0xd1 tag
+// and the attribute's subpacket body in place of the UTF-8 identity
+// string that frames a user ID with 0xb4.
+func userAttributeHash(pk *packet.PublicKey, pkBody, uatBody []byte, hashFunc crypto.Hash) (hash.Hash, error) {
+	if !hashFunc.Available() {
+		return nil, errors.UnsupportedError("hash function")
+	}
+	h := hashFunc.New()
+	pk.SerializeSignaturePrefix(h)
+	h.Write(pkBody)
+
+	var prefix [5]byte
+	prefix[0] = 0xd1
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(uatBody)))
+	h.Write(prefix[:])
+	h.Write(uatBody)
+
+	return h, nil
+}
+
+// ErrNoIssuerKey is returned by VerifyClearsign when keyLookup cannot
+// find the signature's issuer, so callers can trigger a keyserver
+// fetch-and-retry before giving up.
+var ErrNoIssuerKey error = Errors.New("issuer key not found")
+
+// primaryUserId returns the identity a good self-signature has marked
+// as primary, or failing that, the first identity on the key.
+func primaryUserId(pubKey *PubKey) *UserId {
+	for _, uid := range pubKey.Identities {
+		if uid.Primary {
+			return uid
+		}
+	}
+	if len(pubKey.Identities) > 0 {
+		return pubKey.Identities[0]
+	}
+	return nil
+}
+
+// VerifyClearsign decodes a clearsigned message, resolves its issuer
+// through keyLookup, and verifies the signature against the looked-up
+// key. It returns the signing key, the UserId the signature is
+// attributed to (the key's primary identity, since text and binary
+// signatures don't bind to a particular identity), and the verified
+// plaintext.
+func VerifyClearsign(r io.Reader, keyLookup func(keyId uint64) (*PubKey, error)) (*PubKey, *UserId, []byte, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	block, _ := clearsign.Decode(data)
+	if block == nil {
+		return nil, nil, nil, errors.StructuralError("no clearsigned message found")
+	}
+	sigBytes, err := ioutil.ReadAll(block.ArmoredSignature.Body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p, err := packet.Read(bytes.NewReader(sigBytes))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok {
+		return nil, nil, nil, errors.StructuralError("clearsign block does not contain a signature")
+	}
+	if sig.IssuerKeyId == nil {
+		return nil, nil, nil, errors.StructuralError("signature has no issuer key id")
+	}
+	pubKey, err := keyLookup(*sig.IssuerKeyId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if pubKey == nil {
+		return nil, nil, nil, ErrNoIssuerKey
+	}
+	pkPkt, err := pubKey.Parse()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pk := pkPkt.(*packet.PublicKey)
+	if !sig.Hash.Available() {
+		return nil, nil, nil, errors.UnsupportedError("hash function")
+	}
+	h := sig.Hash.New()
+	h.Write(block.Bytes)
+	if err = pk.VerifySignature(h, sig); err != nil {
+		return nil, nil, nil, err
+	}
+	return pubKey, primaryUserId(pubKey), block.Plaintext, nil
 }
\ No newline at end of file
@@ -0,0 +1,137 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hockeypuck
+
+import (
+	"os"
+	"testing"
+)
+
+// readValidKeysFromFile drains ReadValidKeys for path and returns every
+// key and error it produced.
+func readValidKeysFromFile(t *testing.T, path string) ([]*PubKey, []error) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	keyChan, errorChan := ReadValidKeys(f)
+	var keys []*PubKey
+	var errs []error
+	for keyChan != nil || errorChan != nil {
+		select {
+		case key, ok := <-keyChan:
+			if !ok {
+				keyChan = nil
+				continue
+			}
+			keys = append(keys, key)
+		case err, ok := <-errorChan:
+			if !ok {
+				errorChan = nil
+				continue
+			}
+			errs = append(errs, err)
+		}
+	}
+	return keys, errs
+}
+
+// TestCrossSigValidKeyAccepted verifies that a genuinely cross-signed
+// signing subkey -- one carrying a correct embedded primary key binding
+// signature -- is accepted.
+func TestCrossSigValidKeyAccepted(t *testing.T) {
+	keys, errs := readValidKeysFromFile(t, "testdata/chunk0-4_valid_cross_sig.gpg")
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 valid key, got %d", len(keys))
+	}
+	key := keys[0]
+	if len(key.SubKeys) != 1 {
+		t.Fatalf("expected 1 subkey, got %d", len(key.SubKeys))
+	}
+	sub := key.SubKeys[0]
+	if !sub.FlagsValid || !sub.FlagSign {
+		t.Fatalf("expected subkey to be marked signing-capable, got %+v", sub)
+	}
+}
+
+// TestCrossSigAttackRejected reproduces the 2014-era subkey
+// cross-certification attack: a signing-capable subkey genuinely bound
+// to its owner's primary key is re-attached, with a fresh (and
+// otherwise valid) binding signature, to an attacker's own primary key.
+// The attacker controls their own primary private key and so can
+// produce that binding signature unaided, but not the subkey's private
+// key, so the binding carries no embedded primary key binding
+// signature. Without cross-certification enforcement this would make
+// the attacker appear to own the victim's signing key.
+func TestCrossSigAttackRejected(t *testing.T) {
+	keys, errs := readValidKeysFromFile(t, "testdata/chunk0-4_cross_sig_attack.gpg")
+	if len(keys) != 0 {
+		t.Fatalf("expected the forged key to be rejected, got %d valid keys", len(keys))
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly 1 error, got %v", errs)
+	}
+	if errs[0] != MissingCrossSigError {
+		t.Fatalf("expected MissingCrossSigError, got %v", errs[0])
+	}
+}
+
+// TestV3KeyAccepted verifies that a legacy version 3 key -- primary key,
+// user ID, self-signature and subkey binding all version 3 packets --
+// is recognized by ReadKeys and retained by ReadValidKeys, rather than
+// being silently dropped by the go.crypto/openpgp/packet type switch,
+// which still recognizes tags 2, 6 and 14 well enough to hand back a
+// typed (if unparsed) *packet.Signature/*packet.PublicKey.
+func TestV3KeyAccepted(t *testing.T) {
+	keys, errs := readValidKeysFromFile(t, "testdata/chunk0-1_v3_key.gpg")
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 valid key, got %d", len(keys))
+	}
+	key := keys[0]
+	if len(key.Identities) != 1 {
+		t.Fatalf("expected 1 identity, got %d", len(key.Identities))
+	}
+	if len(key.SubKeys) != 1 {
+		t.Fatalf("expected 1 subkey, got %d", len(key.SubKeys))
+	}
+}
+
+// TestKeyRevocationRejected verifies that a direct-key revocation
+// signature (SigTypeKeyRevocation, 0x20) on the primary key causes
+// ReadValidKeys to reject the key, rather than only checking revocations
+// on user IDs and subkeys.
+func TestKeyRevocationRejected(t *testing.T) {
+	keys, errs := readValidKeysFromFile(t, "testdata/chunk0-2_key_revocation.gpg")
+	if len(keys) != 0 {
+		t.Fatalf("expected the revoked key to be rejected, got %d valid keys", len(keys))
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly 1 error, got %v", errs)
+	}
+	if errs[0] != RevokedKeyError {
+		t.Fatalf("expected RevokedKeyError, got %v", errs[0])
+	}
+}
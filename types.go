@@ -0,0 +1,230 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hockeypuck
+
+import (
+	"bytes"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// PacketObject is anything that was read from a single OpenPGP packet
+// and can be re-serialized to it.
+type PacketObject interface {
+	SetPacket(op *packet.OpaquePacket)
+	GetPacket() []byte
+	Parse() (packet.Packet, error)
+}
+
+// Signable is a PacketObject that other packets can certify: primary
+// keys, subkeys, user IDs and user attributes all accept signatures.
+type Signable interface {
+	PacketObject
+	AppendSig(sig *Signature)
+}
+
+// AbstractPacket stores the raw, opaque bytes of the packet a type was
+// parsed from, and implements the PacketObject plumbing common to every
+// concrete packet type.
+type AbstractPacket struct {
+	Packet []byte
+}
+
+func (ap *AbstractPacket) SetPacket(op *packet.OpaquePacket) {
+	var buf bytes.Buffer
+	op.Serialize(&buf)
+	ap.Packet = buf.Bytes()
+}
+
+func (ap *AbstractPacket) GetPacket() []byte {
+	return ap.Packet
+}
+
+func (ap *AbstractPacket) Parse() (packet.Packet, error) {
+	op, err := packet.NewOpaqueReader(bytes.NewReader(ap.Packet)).Next()
+	if err != nil {
+		return nil, err
+	}
+	return op.Parse()
+}
+
+// PubKey represents an OpenPGP primary public key and everything
+// certified under it: user IDs, user attributes and subkeys.
+type PubKey struct {
+	AbstractPacket
+	RFingerprint string
+	Algorithm    int
+	KeyLength    int
+	Identities   []*UserId
+	SubKeys      []*SubKey
+	Signatures   []*Signature
+
+	// Capability flags, taken from the key flags subpacket on the
+	// self-signature over the primary user ID. See Signature.FlagsValid.
+	FlagsValid                bool
+	FlagCertify               bool
+	FlagSign                  bool
+	FlagEncryptCommunications bool
+	FlagEncryptStorage        bool
+
+	// Revoked is set once checkValidSignatures finds a verified key
+	// revocation signature.
+	Revoked bool
+}
+
+// Fingerprint returns the key's fingerprint as a hex string.
+func (pubKey *PubKey) Fingerprint() string {
+	return Reverse(pubKey.RFingerprint)
+}
+
+func (pubKey *PubKey) AppendSig(sig *Signature) {
+	pubKey.Signatures = append(pubKey.Signatures, sig)
+}
+
+// Traverse sends this key and everything certified under it down c, in
+// the order the packets should be written back out in.
+func (pubKey *PubKey) Traverse(c chan PacketObject) {
+	c <- pubKey
+	for _, sig := range pubKey.Signatures {
+		c <- sig
+	}
+	for _, uid := range pubKey.Identities {
+		uid.Traverse(c)
+	}
+	for _, subKey := range pubKey.SubKeys {
+		subKey.Traverse(c)
+	}
+}
+
+// SubKey represents an OpenPGP subkey bound to a PubKey.
+type SubKey struct {
+	AbstractPacket
+	RFingerprint string
+	Algorithm    int
+	KeyLength    int
+	Signatures   []*Signature
+
+	// Capability flags, taken from the key flags subpacket on the
+	// subkey's binding signature. See Signature.FlagsValid.
+	FlagsValid                bool
+	FlagCertify               bool
+	FlagSign                  bool
+	FlagEncryptCommunications bool
+	FlagEncryptStorage        bool
+
+	// Revoked is set once checkValidSignatures finds a verified subkey
+	// revocation signature.
+	Revoked bool
+}
+
+func (subKey *SubKey) AppendSig(sig *Signature) {
+	subKey.Signatures = append(subKey.Signatures, sig)
+}
+
+func (subKey *SubKey) Traverse(c chan PacketObject) {
+	c <- subKey
+	for _, sig := range subKey.Signatures {
+		c <- sig
+	}
+}
+
+// UserId represents an OpenPGP user ID packet and the signatures and
+// user attributes certified alongside it.
+type UserId struct {
+	AbstractPacket
+	Id         string
+	Keywords   []string
+	Signatures []*Signature
+	Attributes []*UserAttribute
+
+	// Primary is set when a good self-signature marks this identity as
+	// the primary user ID (RFC 4880 5.2.3.19).
+	Primary bool
+
+	// Revoked is set once checkValidSignatures finds a verified
+	// certification revocation signature for this identity.
+	Revoked bool
+}
+
+func (uid *UserId) AppendSig(sig *Signature) {
+	uid.Signatures = append(uid.Signatures, sig)
+}
+
+func (uid *UserId) Traverse(c chan PacketObject) {
+	c <- uid
+	for _, sig := range uid.Signatures {
+		c <- sig
+	}
+	for _, uat := range uid.Attributes {
+		uat.Traverse(c)
+	}
+}
+
+// UserAttribute represents an OpenPGP user attribute (e.g. photo ID)
+// packet and its signatures.
+type UserAttribute struct {
+	AbstractPacket
+	Signatures []*Signature
+}
+
+func (uat *UserAttribute) AppendSig(sig *Signature) {
+	uat.Signatures = append(uat.Signatures, sig)
+}
+
+func (uat *UserAttribute) Traverse(c chan PacketObject) {
+	c <- uat
+	for _, sig := range uat.Signatures {
+		c <- sig
+	}
+}
+
+// Signature represents an OpenPGP signature packet.
+type Signature struct {
+	AbstractPacket
+	SigType           int
+	RIssuerKeyId      string
+	CreationTime      int64
+	SigExpirationTime int64
+	KeyExpirationTime int64
+
+	// Key flags (RFC 4880 5.2.3.21), valid only when FlagsValid is true.
+	FlagsValid                bool
+	FlagCertify               bool
+	FlagSign                  bool
+	FlagEncryptCommunications bool
+	FlagEncryptStorage        bool
+
+	// IsPrimaryUserId is set by the primary user ID subpacket
+	// (RFC 4880 5.2.3.19) on a self-signature over a UserId.
+	IsPrimaryUserId bool
+
+	// Preferred algorithms (RFC 4880 5.2.3.7-9), advertised by a
+	// self-signature, as the ordered list of algorithm IDs.
+	PreferredSymmetric   []int
+	PreferredHash        []int
+	PreferredCompression []int
+
+	// KeyServerPreferences holds the raw key server preferences
+	// subpacket (RFC 4880 5.2.3.17), e.g. the no-modify flag.
+	KeyServerPreferences []byte
+
+	// Revocation fields, populated for signature types
+	// SigTypeKeyRevocation, SigTypeSubkeyRevocation and
+	// SigTypeCertificationRevocation (RFC 4880 5.2.3.23).
+	RevocationReasonCode byte
+	RevocationReason     string
+}
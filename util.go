@@ -0,0 +1,59 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hockeypuck
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Reverse returns the characters of s in reverse order. Fingerprints and
+// key IDs are stored reversed so that short-id and fingerprint lookups,
+// which are usually anchored on the low-order bytes, share a common
+// leading prefix in the index.
+func Reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// CleanUtf8 strips invalid UTF-8 byte sequences from s, so that
+// malformed user IDs can still be stored and indexed.
+func CleanUtf8(s string) string {
+	v := make([]rune, 0, len(s))
+	for i, r := range s {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(s[i:]); size == 1 {
+				continue
+			}
+		}
+		v = append(v, r)
+	}
+	return string(v)
+}
+
+var userIdWordPattern = regexp.MustCompile(`[\pL\pN]+`)
+
+// SplitUserId splits a user ID string into lower-cased keywords suitable
+// for indexing and search.
+func SplitUserId(id string) []string {
+	return userIdWordPattern.FindAllString(strings.ToLower(id), -1)
+}